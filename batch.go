@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"time"
+)
+
+// SyncMode controls how aggressively the background syncer in runSyncer
+// flushes pending Batch commits to disk.
+type SyncMode int
+
+const (
+	// SyncAlways fsyncs as soon as a Commit arrives, coalescing it with
+	// whatever else is already queued at that moment.
+	SyncAlways SyncMode = iota
+	// SyncInterval only fsyncs on the periodic tick driven by the WAL's
+	// duration, batching every Commit that arrived since the last one.
+	SyncInterval
+	// SyncNever never fsyncs on its own; callers must call Flush.
+	SyncNever
+)
+
+// WALOptions configures optional WAL behavior beyond the required
+// constructor arguments.
+type WALOptions struct {
+	SyncMode SyncMode
+}
+
+// commitRequest is one Batch.Commit call waiting on the syncer.
+type commitRequest struct {
+	entries []Entry
+	done    chan error
+}
+
+// Batch stages writes in memory and commits them together under a single
+// fsync, amortizing sync cost across however many keys are written at
+// once - the group-commit pattern etcd and Prometheus use for their WALs.
+type Batch struct {
+	wal     *WAL
+	entries []Entry
+}
+
+// Batch returns a handle for staging a group of writes to commit together.
+func (wal *WAL) Batch() *Batch {
+	return &Batch{wal: wal}
+}
+
+// Put stages a write; it isn't durable or visible to readers until
+// Commit succeeds.
+func (b *Batch) Put(key string, value []byte, deleted bool) {
+	b.entries = append(b.entries, Entry{Key: key, Value: value, Deleted: deleted})
+}
+
+// Commit hands the batch to the background syncer and blocks until it -
+// along with every other Commit the syncer coalesced with it - has been
+// written, and synced unless the WAL is in SyncNever mode.
+func (b *Batch) Commit() error {
+	if len(b.entries) == 0 {
+		return nil
+	}
+
+	req := &commitRequest{entries: b.entries, done: make(chan error, 1)}
+	b.wal.commitQueue <- req
+	return <-req.done
+}
+
+// runSyncer drains commitQueue for the life of the WAL. On SyncAlways it
+// flushes as soon as a request arrives, first draining anything else
+// already queued so one write+fsync covers every commit pending at that
+// instant. On SyncInterval it instead waits for the next wal.d tick,
+// batching everything that arrived in between.
+func (wal *WAL) runSyncer() {
+	go func() {
+		ticker := time.NewTicker(wal.d)
+		defer ticker.Stop()
+
+		var pending []*commitRequest
+		flush := func() {
+			if len(pending) == 0 {
+				return
+			}
+			err := wal.writeBatch(pending)
+			for _, req := range pending {
+				req.done <- err
+				close(req.done)
+			}
+			pending = nil
+		}
+
+		for {
+			select {
+			case req, ok := <-wal.commitQueue:
+				if !ok {
+					flush()
+					return
+				}
+				pending = append(pending, req)
+				for drained := false; !drained; {
+					select {
+					case more := <-wal.commitQueue:
+						pending = append(pending, more)
+					default:
+						drained = true
+					}
+				}
+				if wal.opts.SyncMode != SyncInterval {
+					flush()
+				}
+			case <-ticker.C:
+				flush()
+			}
+		}
+	}()
+}
+
+// writeBatch encodes every entry from every pending commit into one
+// buffer and appends it to the tail segment with a single tail.Update
+// call, rolling to a new segment first if the group would overflow
+// maxSize - the same invariant Set enforces for individual writes. Unless
+// the WAL is in SyncNever mode, the whole group is then flushed with a
+// single fsync, so one sync covers everything pending at coalesce time.
+func (wal *WAL) writeBatch(pending []*commitRequest) error {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	tail, err := wal.getLastSegment()
+	if err != nil {
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf, wal.lastCRC, wal.crcTable)
+	var size int64
+	lastCRC := wal.lastCRC
+	for _, req := range pending {
+		for i := range req.entries {
+			if err := enc.Encode(&req.entries[i]); err != nil {
+				return err
+			}
+			lastCRC = req.entries[i].Crc
+			size += int64(VALUE_SIZE) + int64(len(req.entries[i].Key)) + int64(len(req.entries[i].Value))
+		}
+	}
+	if size == 0 {
+		return nil
+	}
+
+	if tail.Size()+size > wal.maxSize {
+		if !tail.IsSynced() {
+			if err := wal.Flush(); err != nil {
+				return err
+			}
+			tail.SetSynced(true)
+		}
+
+		tail, err = wal.newSegment()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := wal.Update(buf.Bytes(), tail); err != nil {
+		return err
+	}
+
+	wal.lastCRC = lastCRC
+	tail.SetSynced(false)
+
+	if wal.opts.SyncMode != SyncNever {
+		if err := wal.Flush(); err != nil {
+			return err
+		}
+		tail.SetSynced(true)
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CheckpointInfo describes a completed checkpoint.
+type CheckpointInfo struct {
+	Path     string
+	Index    int64
+	Keys     int
+	Segments int
+	Duration time.Duration
+}
+
+// Checkpoint reads every segment older than the retention window
+// ([0, lastIndex-lowMark)), together with the previous checkpoint's
+// survivors if there is one, collapses them down to one survivor per key -
+// the latest write, dropped entirely if it was a tombstone or keep
+// rejects it - and writes the survivors to a new checkpoint file under
+// <path>/checkpoints/. Only once that file is fsynced are the source
+// segments removed, so a crash mid-checkpoint never loses live data the
+// way cleanLog's blind deletion could.
+func (wal *WAL) Checkpoint(ctx context.Context, keep func(e Entry) bool) (CheckpointInfo, error) {
+	start := time.Now()
+
+	wal.mu.Lock()
+	segments := append([]*Segment{}, wal.segments...)
+	upto := wal.lastIndex - int64(wal.lowMark)
+	prevCheckpoint := wal.checkpointPath
+	wal.mu.Unlock()
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i].Index() < segments[j].Index() })
+
+	covered := make([]*Segment, 0, len(segments))
+	for _, s := range segments {
+		if s.Index() >= upto {
+			break
+		}
+		covered = append(covered, s)
+	}
+	if len(covered) == 0 {
+		return CheckpointInfo{}, nil
+	}
+
+	latest := map[string]Entry{}
+	if prevCheckpoint != "" {
+		prior, err := wal.decodeCheckpoint(prevCheckpoint)
+		if err != nil {
+			return CheckpointInfo{}, err
+		}
+		for _, e := range prior {
+			latest[e.Key] = e
+		}
+	}
+	for _, s := range covered {
+		select {
+		case <-ctx.Done():
+			return CheckpointInfo{}, ctx.Err()
+		default:
+		}
+
+		entries, err := wal.decodeSegment(s)
+		if err != nil {
+			return CheckpointInfo{}, err
+		}
+		for _, e := range entries {
+			latest[e.Key] = e
+		}
+	}
+
+	survivors := make([]Entry, 0, len(latest))
+	for _, e := range latest {
+		if e.Deleted {
+			continue
+		}
+		if keep != nil && !keep(e) {
+			continue
+		}
+		survivors = append(survivors, e)
+	}
+
+	dir := filepath.Join(wal.path, CHECKPOINT_DIR)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return CheckpointInfo{}, err
+	}
+
+	index := covered[len(covered)-1].Index()
+	path := filepath.Join(dir, fmt.Sprintf(CHECKPOINT_FORMAT, index))
+
+	f, err := os.Create(path)
+	if err != nil {
+		return CheckpointInfo{}, err
+	}
+
+	enc := NewEncoder(f, 0, wal.crcTable)
+	for i := range survivors {
+		if err := enc.Encode(&survivors[i]); err != nil {
+			f.Close()
+			return CheckpointInfo{}, err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return CheckpointInfo{}, err
+	}
+	if err := f.Close(); err != nil {
+		return CheckpointInfo{}, err
+	}
+
+	wal.mu.Lock()
+	for _, s := range covered {
+		if err := os.Remove(s.Path()); err != nil {
+			wal.mu.Unlock()
+			return CheckpointInfo{}, err
+		}
+		os.Remove(segmentIndexPath(s.Path())) // sidecar index, best effort
+		for i, seg := range wal.segments {
+			if seg == s {
+				wal.removeIndex(i)
+				break
+			}
+		}
+	}
+	wal.checkpointIndex = index
+	wal.checkpointPath = path
+	wal.mu.Unlock()
+
+	return CheckpointInfo{
+		Path:     path,
+		Index:    index,
+		Keys:     len(survivors),
+		Segments: len(covered),
+		Duration: time.Since(start),
+	}, nil
+}
+
+// decodeCheckpoint reads back every survivor Entry a prior Checkpoint
+// wrote to path, so Replay can fold them in before it ever looks at a
+// segment - otherwise the keys Checkpoint compacted away would simply be
+// missing from recovery.
+func (wal *WAL) decodeCheckpoint(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := NewDecoder(f, 0, wal.crcTable)
+	entries := []Entry{}
+	for {
+		e, err := dec.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, *e)
+	}
+	return entries, nil
+}
+
+// LastCheckpoint returns the most recent checkpoint file under dir, or
+// index -1 if dir holds none.
+func LastCheckpoint(dir string) (string, int64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", -1, nil
+		}
+		return "", -1, err
+	}
+
+	path := ""
+	index := int64(-1)
+	for _, fi := range files {
+		if fi.IsDir() || !strings.HasPrefix(fi.Name(), "checkpoint.") {
+			continue
+		}
+
+		name := strings.TrimPrefix(fileNameWithoutExtension(fi.Name()), "checkpoint.")
+		i, err := convertIndex(name)
+		if err != nil {
+			continue
+		}
+		if i > index {
+			index = i
+			path = filepath.Join(dir, fi.Name())
+		}
+	}
+	if path == "" {
+		return "", -1, nil
+	}
+	return path, index, nil
+}
@@ -0,0 +1,41 @@
+// Package crc provides a hash/crc32-compatible hash.Hash32 that can be
+// seeded with the CRC of whatever came before it, so a chain of records
+// (and segments) can be linked together: each value's CRC depends on every
+// value that preceded it, the same way etcd's WAL detects torn writes and
+// bit rot across file boundaries.
+package crc
+
+import (
+	"hash"
+	"hash/crc32"
+)
+
+type digest struct {
+	crc uint32
+	tab *crc32.Table
+}
+
+// New returns a hash.Hash32 identical to the ones in hash/crc32, except its
+// running sum starts at prev instead of 0. Seeding New with the previous
+// record's (or segment's) Sum32() chains the checksums together.
+func New(prev uint32, tab *crc32.Table) hash.Hash32 {
+	return &digest{prev, tab}
+}
+
+func (d *digest) Write(p []byte) (n int, err error) {
+	d.crc = crc32.Update(d.crc, d.tab, p)
+	return len(p), nil
+}
+
+func (d *digest) Sum32() uint32 { return d.crc }
+
+func (d *digest) Reset() { d.crc = 0 }
+
+func (d *digest) Size() int { return crc32.Size }
+
+func (d *digest) BlockSize() int { return 1 }
+
+func (d *digest) Sum(in []byte) []byte {
+	s := d.Sum32()
+	return append(in, byte(s>>24), byte(s>>16), byte(s>>8), byte(s))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/MilosSimic/wal/crc"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// Decoder reads Entry records from r one at a time, verifying the CRC
+// chain as it goes. Like Encoder, a single Decoder keeps its hash.Hash32
+// across Decode calls so the chain carries forward record to record.
+type Decoder struct {
+	r      io.Reader
+	crc    hash.Hash32
+	offset int64 // byte offset of the next record to read
+	last   int64 // byte offset of the record returned by the last Decode call
+	index  int64
+}
+
+// NewDecoder returns a Decoder reading from r, with its CRC chain seeded
+// at seed - the segment's startCRC (the previous segment's footer, or 0
+// for the first segment), or 0 for a checkpoint file.
+func NewDecoder(r io.Reader, seed uint32, tab *crc32.Table) *Decoder {
+	return &Decoder{r: r, crc: crc.New(seed, tab)}
+}
+
+// Decode reads and verifies the next record, returning io.EOF once r is
+// exhausted cleanly at a record boundary.
+func (dec *Decoder) Decode() (*Entry, error) {
+	header := make([]byte, VALUE_SIZE)
+	if _, err := io.ReadFull(dec.r, header); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+
+	wantCRC := binary.LittleEndian.Uint32(header[:C_SIZE])
+	timestamp := binary.LittleEndian.Uint64(header[C_SIZE:CRC_SIZE])
+	deleted := header[CRC_SIZE] == 1
+	keySize := binary.LittleEndian.Uint64(header[TOMBSTONE_SIZE:KEY_SIZE])
+	valueSize := binary.LittleEndian.Uint64(header[KEY_SIZE:VALUE_SIZE])
+
+	body := make([]byte, keySize+valueSize)
+	if _, err := io.ReadFull(dec.r, body); err != nil {
+		return nil, err
+	}
+
+	dec.crc.Write(header[C_SIZE:])
+	dec.crc.Write(body)
+	if dec.crc.Sum32() != wantCRC {
+		return nil, &ErrCRCMismatch{Index: dec.index, Offset: dec.offset}
+	}
+
+	e := &Entry{
+		Crc:       wantCRC,
+		Timestamp: timestamp,
+		Deleted:   deleted,
+		Key:       string(body[:keySize]),
+		Value:     body[keySize:],
+	}
+
+	dec.last = dec.offset
+	dec.offset += int64(VALUE_SIZE) + int64(keySize) + int64(valueSize)
+	dec.index++
+	return e, nil
+}
+
+// Offset returns the byte offset of the record returned by the last
+// Decode call.
+func (dec *Decoder) Offset() int64 {
+	return dec.last
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/MilosSimic/wal/crc"
+	"hash"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// Encoder writes Entry records to w one at a time, chaining each record's
+// CRC from the one written before it. Construct one per tail segment,
+// seeded with that segment's startCRC (or the previous record's CRC if
+// resuming a segment already in progress), and keep reusing it for every
+// Encode call so the chain carries forward correctly.
+type Encoder struct {
+	w   io.Writer
+	crc hash.Hash32
+}
+
+// NewEncoder returns an Encoder writing to w, with its CRC chain seeded
+// at prev.
+func NewEncoder(w io.Writer, prev uint32, tab *crc32.Table) *Encoder {
+	return &Encoder{w: w, crc: crc.New(prev, tab)}
+}
+
+// Encode stamps e with the current time (unless it already carries a
+// timestamp - Checkpoint re-encodes already-decoded survivor Entrys and
+// must not overwrite their original write time) and the next CRC in the
+// chain, then writes it to the underlying writer.
+func (enc *Encoder) Encode(e *Entry) error {
+	if e.Timestamp == 0 {
+		e.Timestamp = uint64(time.Now().Unix())
+	}
+
+	secb := make([]byte, T_SIZE)
+	binary.LittleEndian.PutUint64(secb, e.Timestamp)
+
+	tombstone := byte(0)
+	if e.Deleted {
+		tombstone = 1
+	}
+
+	keyb := []byte(e.Key)
+	keybs := make([]byte, T_SIZE)
+	binary.LittleEndian.PutUint64(keybs, uint64(len(keyb)))
+
+	valuebs := make([]byte, T_SIZE)
+	binary.LittleEndian.PutUint64(valuebs, uint64(len(e.Value)))
+
+	payload := make([]byte, 0, T_SIZE+1+T_SIZE+T_SIZE+len(keyb)+len(e.Value))
+	payload = append(payload, secb...)
+	payload = append(payload, tombstone)
+	payload = append(payload, keybs...)
+	payload = append(payload, valuebs...)
+	payload = append(payload, keyb...)
+	payload = append(payload, e.Value...)
+
+	enc.crc.Write(payload)
+	e.Crc = enc.crc.Sum32()
+
+	crcb := make([]byte, C_SIZE)
+	binary.LittleEndian.PutUint32(crcb, e.Crc)
+
+	if _, err := enc.w.Write(crcb); err != nil {
+		return err
+	}
+	_, err := enc.w.Write(payload)
+	return err
+}
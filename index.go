@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/MilosSimic/lru"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// indexEntry is one sidecar index row: a key's timestamp, byte offset and
+// tombstone state for the *last* (by write order) occurrence of that key
+// within its segment.
+type indexEntry struct {
+	Key       string
+	Timestamp uint64
+	Offset    int64
+	Deleted   bool
+}
+
+func segmentIndexPath(path string) string {
+	return path + ".idx"
+}
+
+// buildKeyIndex decodes segment once and writes a complete per-key
+// index - one row per distinct key, holding that key's last occurrence in
+// the segment - to the segment's sidecar .idx file, sorted by key.
+//
+// A segment is append-only and written in time order, not key order, so a
+// sampled index (one row every Nth record, sorted by key) can't be bounded
+// correctly: the records following a sampled row's offset are simply
+// whatever was written next, with unrelated keys, not neighbors of that
+// row's key. Indexing every key instead means a binary search match is
+// always the exact record wanted, with no follow-on scan needed.
+func (wal *WAL) buildKeyIndex(segment *Segment) error {
+	r, err := wal.segmentReader(segment)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	dec := NewDecoder(r, segment.startCRC, wal.crcTable)
+	latest := map[string]indexEntry{}
+	for {
+		e, err := dec.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		latest[e.Key] = indexEntry{Key: e.Key, Timestamp: e.Timestamp, Offset: dec.Offset(), Deleted: e.Deleted}
+	}
+
+	entries := make([]indexEntry, 0, len(latest))
+	for _, ie := range latest {
+		entries = append(entries, ie)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+
+	f, err := os.Create(segmentIndexPath(segment.Path()))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, ie := range entries {
+		if err := writeIndexEntry(f, ie); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeIndexEntry(w io.Writer, ie indexEntry) error {
+	keyb := []byte(ie.Key)
+	head := make([]byte, 3*T_SIZE+1)
+	binary.LittleEndian.PutUint64(head[0:T_SIZE], uint64(len(keyb)))
+	binary.LittleEndian.PutUint64(head[T_SIZE:2*T_SIZE], ie.Timestamp)
+	binary.LittleEndian.PutUint64(head[2*T_SIZE:3*T_SIZE], uint64(ie.Offset))
+	if ie.Deleted {
+		head[3*T_SIZE] = 1
+	}
+	if _, err := w.Write(head); err != nil {
+		return err
+	}
+	_, err := w.Write(keyb)
+	return err
+}
+
+// loadIndexBlock returns segment's index, decoding its sidecar file
+// (building it first if this segment predates indexing) and caching the
+// block in wal.cache under "segmentIndex:blockNo" - there is a single
+// block per segment today, so blockNo is always 0.
+func (wal *WAL) loadIndexBlock(segment *Segment) ([]indexEntry, error) {
+	cacheKey := strconv.FormatInt(segment.Index(), 10) + ":0"
+	if entries, err := wal.findIndexInCache(cacheKey); err == nil {
+		return entries, nil
+	}
+
+	path := segmentIndexPath(segment.Path())
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := wal.buildKeyIndex(segment); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []indexEntry{}
+	head := make([]byte, 3*T_SIZE+1)
+	for {
+		if _, err := io.ReadFull(f, head); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		keyLen := binary.LittleEndian.Uint64(head[0:T_SIZE])
+		timestamp := binary.LittleEndian.Uint64(head[T_SIZE : 2*T_SIZE])
+		offset := int64(binary.LittleEndian.Uint64(head[2*T_SIZE : 3*T_SIZE]))
+		deleted := head[3*T_SIZE] == 1
+
+		keyb := make([]byte, keyLen)
+		if _, err := io.ReadFull(f, keyb); err != nil {
+			return nil, err
+		}
+		entries = append(entries, indexEntry{Key: string(keyb), Timestamp: timestamp, Offset: offset, Deleted: deleted})
+	}
+
+	wal.cacheIndex(cacheKey, entries)
+	return entries, nil
+}
+
+func (wal *WAL) findIndexInCache(key string) ([]indexEntry, error) {
+	v, ok := wal.cache.Get(key)
+	if !ok {
+		return nil, errors.New("Cache miss!")
+	}
+	val := v.(*lru.Elem).Value
+	entries, ok := val.([]indexEntry)
+	if !ok {
+		return nil, errors.New("Conversion error")
+	}
+	return entries, nil
+}
+
+func (wal *WAL) cacheIndex(key string, entries []indexEntry) error {
+	_, ok := wal.cache.Put(key, entries)
+	if !ok {
+		return errors.New("Cache error")
+	}
+	return nil
+}
+
+// Lookup returns key's most recent live value. Segments are searched
+// newest to oldest; within each, the index (one row per key) is binary
+// searched for an exact match; the tail segment, still being written, is
+// scanned directly instead. The first segment that has any row for key
+// settles the lookup - if that row is a tombstone, key is deleted,
+// regardless of what older segments hold.
+func (wal *WAL) Lookup(key string) (*Entry, error) {
+	wal.mu.Lock()
+	segments := append([]*Segment{}, wal.segments...)
+	tailIndex := wal.lastIndex
+	wal.mu.Unlock()
+	sort.Slice(segments, func(i, j int) bool { return segments[i].Index() > segments[j].Index() })
+
+	for _, segment := range segments {
+		if segment.Index() == tailIndex {
+			tailEntries, err := wal.decodeSegment(segment)
+			if err != nil {
+				return nil, err
+			}
+			for i := len(tailEntries) - 1; i >= 0; i-- {
+				if tailEntries[i].Key != key {
+					continue
+				}
+				if tailEntries[i].Deleted {
+					return nil, ErrKeyNotFound
+				}
+				return &tailEntries[i], nil
+			}
+			continue
+		}
+
+		entries, err := wal.loadIndexBlock(segment)
+		if err != nil {
+			return nil, err
+		}
+
+		i := sort.Search(len(entries), func(i int) bool { return entries[i].Key >= key })
+		if i >= len(entries) || entries[i].Key != key {
+			continue
+		}
+		if entries[i].Deleted {
+			return nil, ErrKeyNotFound
+		}
+
+		e, err := wal.readEntryAt(segment, entries[i].Offset)
+		if err != nil {
+			return nil, err
+		}
+		return e, nil
+	}
+	return nil, ErrKeyNotFound
+}
+
+// readEntryAt reads the single raw record starting at offset in segment.
+func (wal *WAL) readEntryAt(segment *Segment, offset int64) (*Entry, error) {
+	f, err := os.Open(segment.Path())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return readRawEntry(f)
+}
+
+// readRawEntry parses one record's fields without verifying its CRC - the
+// chain was already verified when the segment was written, replayed, or
+// indexed.
+func readRawEntry(r io.Reader) (*Entry, error) {
+	header := make([]byte, VALUE_SIZE)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	crcVal := binary.LittleEndian.Uint32(header[:C_SIZE])
+	timestamp := binary.LittleEndian.Uint64(header[C_SIZE:CRC_SIZE])
+	deleted := header[CRC_SIZE] == 1
+	keySize := binary.LittleEndian.Uint64(header[TOMBSTONE_SIZE:KEY_SIZE])
+	valueSize := binary.LittleEndian.Uint64(header[KEY_SIZE:VALUE_SIZE])
+
+	body := make([]byte, keySize+valueSize)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	return &Entry{
+		Crc:       crcVal,
+		Timestamp: timestamp,
+		Deleted:   deleted,
+		Key:       string(body[:keySize]),
+		Value:     body[keySize:],
+	}, nil
+}
+
+// RangeByTime calls fn with every record timestamped in [from, to], oldest
+// segment first, stopping early if fn returns false.
+func (wal *WAL) RangeByTime(from, to uint64, fn func(Entry) bool) error {
+	wal.mu.Lock()
+	segments := append([]*Segment{}, wal.segments...)
+	wal.mu.Unlock()
+	sort.Slice(segments, func(i, j int) bool { return segments[i].Index() < segments[j].Index() })
+
+	for _, segment := range segments {
+		entries, err := wal.decodeSegment(segment)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.Timestamp < from || e.Timestamp > to {
+				continue
+			}
+			if !fn(e) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
@@ -1,10 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
-	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -17,7 +18,13 @@ import (
 +---------------+-----------------+---------------+---------------+-----------------+-...-+--...--+
 |    CRC (4B)   | Timestamp (16B) | Tombstone(1B) | Key Size (8B) | Value Size (8B) | Key | Value |
 +---------------+-----------------+---------------+---------------+-----------------+-...-+--...--+
-CRC = 32bit hash computed over the payload using CRC
+CRC = 32bit hash chained across every record in the WAL: it is computed over
+      the rest of this record's payload (timestamp, tombstone, key size,
+      value size, key, value) seeded with the previous record's CRC, so a
+      broken chain anywhere - including across a segment boundary - is
+      detectable. The first record of a segment is seeded with the last
+      CRC of the previous segment, which is stored as that segment's
+      trailing 4 byte footer.
 Key Size = Length of the Key data
 Tombstone = If this record was deleted and has a value
 Value Size = Length of the Value data
@@ -26,77 +33,6 @@ Value = Value data
 Timestamp = Timestamp of the operation in seconds
 */
 
-func (wal *WAL) Process(key string, value []byte, deleted bool) []byte {
-	data := []byte{}
-
-	crcb := make([]byte, C_SIZE)
-	binary.LittleEndian.PutUint32(crcb, CRC32(string(value)))
-	data = append(data, crcb...)
-
-	sec := time.Now().Unix()
-	secb := make([]byte, T_SIZE)
-	binary.LittleEndian.PutUint64(secb, uint64(sec))
-	data = append(data, secb...)
-
-	//0 alive 1 deleted
-	if deleted {
-		data = append(data, 1)
-	} else {
-		data = append(data, 0)
-	}
-
-	keyb := []byte(key)
-	keybs := make([]byte, T_SIZE)
-	binary.LittleEndian.PutUint64(keybs, uint64(len(keyb)))
-
-	valuebs := make([]byte, T_SIZE)
-	binary.LittleEndian.PutUint64(valuebs, uint64(len(value)))
-
-	data = append(data, keybs...)
-	data = append(data, valuebs...)
-
-	data = append(data, key...)
-	data = append(data, value...)
-
-	return data
-}
-
-func (wal *WAL) convert(data []byte) []Entry {
-	rez := []Entry{}
-	if len(data) == 0 {
-		return rez
-	}
-
-	i := uint64(0)
-	for i < uint64(len(data)) {
-		crc := binary.LittleEndian.Uint32(data[i : i+C_SIZE])
-		timestamp := binary.LittleEndian.Uint64(data[i+C_SIZE : i+CRC_SIZE])
-		tombstone := data[i+CRC_SIZE]
-		key_size := binary.LittleEndian.Uint64(data[i+TOMBSTONE_SIZE : i+KEY_SIZE])
-		value_size := binary.LittleEndian.Uint64(data[i+KEY_SIZE : i+VALUE_SIZE])
-		key_data := string(data[i+VALUE_SIZE : i+VALUE_SIZE+key_size])
-		val := data[i+VALUE_SIZE+key_size : i+VALUE_SIZE+key_size+value_size]
-
-		b := false
-		if tombstone == 1 {
-			b = true
-		}
-
-		e := Entry{
-			crc,
-			timestamp,
-			b,
-			key_data,
-			val,
-		}
-		rez = append(rez, e)
-
-		// valculate new index
-		i = i + VALUE_SIZE + key_size + value_size
-	}
-	return rez
-}
-
 func (wal *WAL) Read(index int64) ([]byte, error) {
 	// Test the last segment first
 	if index >= wal.lastIndex {
@@ -115,81 +51,145 @@ func (wal *WAL) Read(index int64) ([]byte, error) {
 	return segment.getSegmentData()
 }
 
+// ReadConverted decodes and verifies every record in the segment holding
+// index, streaming it through a Decoder instead of parsing the whole
+// segment into memory at once.
 func (wal *WAL) ReadConverted(index int64) ([]Entry, error) {
-	// Test the last segment first
+	var segment *Segment
+	var err error
 	if index >= wal.lastIndex {
-		segment, err := wal.getLastSegment()
-		if err != nil {
-			return nil, err
+		segment, err = wal.getLastSegment()
+	} else {
+		segment, err = wal.findSegment(index)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := wal.segmentReader(segment)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	dec := NewDecoder(r, segment.startCRC, wal.crcTable)
+	entries := []Entry{}
+	for {
+		e, err := dec.Decode()
+		if err == io.EOF {
+			break
 		}
-		bytes, err := segment.getSegmentData()
 		if err != nil {
 			return nil, err
 		}
-		return wal.convert(bytes), nil
+		entries = append(entries, *e)
 	}
+	return entries, nil
+}
 
-	//search in all segments
-	segment, err := wal.findSegment(index)
+// segmentReader opens segment for reading and bounds the stream to its
+// record data: a finalized segment carries a trailing 4 byte CRC footer
+// that must not be handed to a Decoder as if it were another record.
+// segment.Size() always includes that footer once the segment is
+// finalized - whether it was finalized by newSegment in this process (it
+// folds the footer into size via wal.Update/Segment.Append) or read back
+// by Open from a file finalized in an earlier one (fi.Size() already
+// counts the footer on disk) - so a single subtraction covers both.
+func (wal *WAL) segmentReader(segment *Segment) (io.ReadCloser, error) {
+	f, err := os.Open(segment.Path())
 	if err != nil {
 		return nil, err
 	}
-	bytes, err := segment.getSegmentData()
-	if err != nil {
-		return nil, err
+
+	size := segment.Size()
+	if segment.Index() != wal.lastIndex {
+		size -= C_SIZE
 	}
-	return wal.convert(bytes), nil
+	if size < 0 {
+		size = 0
+	}
+
+	return &boundedFile{f: f, r: io.LimitReader(f, size)}, nil
 }
 
+// boundedFile pairs an *os.File with an io.LimitReader over it, so Read
+// stops at the record data and Close still releases the underlying file.
+type boundedFile struct {
+	f *os.File
+	r io.Reader
+}
+
+func (b *boundedFile) Read(p []byte) (int, error) { return b.r.Read(p) }
+func (b *boundedFile) Close() error                { return b.f.Close() }
+
 func (wal *WAL) Set(key string, value []byte, deleted bool) error {
-	data := wal.Process(key, value, deleted)
-	dataSize := int64(len(data))
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
 	tail, err := wal.getLastSegment()
 	if err != nil {
-		if tail.Size()+dataSize <= wal.maxSize {
-			tail.Append(data, dataSize)
-			tail.SetSynced(false)
-		} else {
-			//Flush previos segment data to disk
-			if !tail.IsSynced() {
-				wal.Flush()
-				tail.SetSynced(true)
-			}
+		return err
+	}
 
-			//Create new segment and append data
-			newTail, err := wal.newSegment()
-			if err != nil {
+	e := &Entry{Key: key, Value: value, Deleted: deleted}
+	size := int64(VALUE_SIZE) + int64(len(key)) + int64(len(value))
+
+	if tail.Size()+size > wal.maxSize {
+		if !tail.IsSynced() {
+			if err := wal.Flush(); err != nil {
 				return err
 			}
-
-			newTail.Append(data, dataSize)
+			tail.SetSynced(true)
 		}
-	}
-	return err
-}
 
-func (wal *WAL) Flush() error {
-	tail, err := wal.getLastSegment()
-	if err != nil {
-		n, err := wal.tail.Write(tail.Data())
+		tail, err = wal.newSegment()
 		if err != nil {
 			return err
 		}
+	}
 
-		if int64(n) != tail.Size() {
-			return errors.New("Error writing data to segment file")
-		}
+	// wal.tail is an *fmmap.FMMAP, not an io.Writer, so - same as
+	// writeBatch - encode into a buffer first and append it through
+	// wal.Update, the one path that knows how to grow the mmap'd tail.
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf, wal.lastCRC, wal.crcTable)
+	if err := enc.Encode(e); err != nil {
+		return err
+	}
 
-		fmt.Println("Flush!!")
+	if err := wal.Update(buf.Bytes(), tail); err != nil {
+		return err
 	}
-	return err
+
+	wal.lastCRC = e.Crc
+	tail.SetSynced(false)
+	return nil
+}
+
+// Flush fsyncs the tail segment, the hook SyncNever callers must use
+// since the syncer goroutine won't fsync on their behalf. fmmap has no
+// Sync of its own - durability on a memory-mapped file still goes
+// through the backing *os.File, so sync that directly.
+func (wal *WAL) Flush() error {
+	_, err := wal.getLastSegment()
+	if err != nil {
+		return err
+	}
+	return wal.tail.GetFile().Sync()
 }
 
 func (wal *WAL) Open() error {
 	wal.mu.Lock()
 	defer wal.mu.Unlock()
 	err := filepath.Walk(wal.path, func(path string, info os.FileInfo, err error) error {
-		if info.IsDir() || filepath.Ext(path) != ".wal" {
+		if info.IsDir() {
+			// Checkpoint files live here too but aren't segments.
+			if info.Name() == CHECKPOINT_DIR {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(path) != ".wal" {
 			return nil
 		}
 
@@ -226,9 +226,55 @@ func (wal *WAL) Open() error {
 	if err != nil {
 		return err
 	}
+
+	// Segments are discovered in filename (index) order, so each one's
+	// chain seed is the footer of the segment right before it.
+	for i := 1; i < len(wal.segments); i++ {
+		startCRC, err := readSegmentFooter(wal.segments[i-1].Path())
+		if err != nil {
+			return err
+		}
+		wal.segments[i].startCRC = startCRC
+	}
+
+	// A checkpoint already folded in everything up to and including
+	// checkpointIndex, so Replay skips decoding those segments again and
+	// instead applies the checkpoint's own survivor file first.
+	wal.checkpointIndex = -1
+	wal.checkpointPath = ""
+	if path, index, err := LastCheckpoint(filepath.Join(wal.path, CHECKPOINT_DIR)); err == nil && index >= 0 {
+		wal.checkpointIndex = index
+		wal.checkpointPath = path
+	}
+
 	return wal.setupLastSegment()
 }
 
+// readSegmentFooter reads the trailing 4 byte CRC footer a finalized
+// segment was closed out with - the seed the next segment's chain starts
+// from.
+func readSegmentFooter(path string) (uint32, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if fi.Size() < C_SIZE {
+		return 0, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	footer := make([]byte, C_SIZE)
+	if _, err := f.ReadAt(footer, fi.Size()-C_SIZE); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(footer), nil
+}
+
 func (tail *Segment) loadSegmentData() error {
 	data, err := ioutil.ReadFile(tail.path)
 	if err != nil {
@@ -270,25 +316,48 @@ func (wal *WAL) setupLastSegment() error {
 	lastSegment, err := wal.getLastSegment()
 	if err == nil {
 		//Open file
-		wal.tail, err = os.OpenFile(lastSegment.Path(), os.O_WRONLY, 0666) // open as WRITE ONLY
+		wal.tail, err = open(lastSegment.Path())
 		if err != nil {
 			return err
 		}
 
-		// Set that data will be appended to file
-		if _, err = wal.tail.Seek(0, 2); err != nil { // append only to end of file
-			return err
-		}
-
 		//Fill data to memory from last segment
 		lastSegment.loadSegmentData()
+
+		// Resume the CRC chain where the tail segment left off, so the
+		// next record written picks up right after the last one on disk.
+		wal.lastCRC = lastSegment.startCRC
+		dec := NewDecoder(bytes.NewReader(lastSegment.Data()), lastSegment.startCRC, wal.crcTable)
+		for {
+			e, err := dec.Decode()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			wal.lastCRC = e.Crc
+		}
 	}
 	return err
 }
 
 func (wal *WAL) newSegment() (*Segment, error) {
+	// Write the chain footer so the next segment knows what CRC to seed
+	// its first record with, through the same tail.Update path every
+	// other write uses (fmmap has no Write) - and fold its bytes into
+	// the finalized segment's size, so a segment rolled in this process
+	// ends up the same size segmentReader expects of one reopened later.
+	if tail, ferr := wal.findSegment(wal.lastIndex); ferr == nil && tail != nil {
+		footer := make([]byte, C_SIZE)
+		binary.LittleEndian.PutUint32(footer, wal.lastCRC)
+		if err := wal.Update(footer, tail); err != nil {
+			return nil, err
+		}
+	}
+
 	//Close the previous tail file
-	prevTail := wal.tail.Name()
+	prevTail := wal.tail.GetFile().Name()
 	wal.tail.Close()
 
 	//Rename previous last segment and remove _END mark and append to new one
@@ -298,6 +367,15 @@ func (wal *WAL) newSegment() (*Segment, error) {
 		return nil, err
 	}
 
+	// Now that the previous tail is finalized, its key index can be built
+	// once and reused by every future Lookup call.
+	if finalized, ferr := wal.findSegment(wal.lastIndex); ferr == nil && finalized != nil {
+		finalized.path = regularPath
+		if err := wal.buildKeyIndex(finalized); err != nil {
+			return nil, err
+		}
+	}
+
 	//Create new segment file and assign to tail
 	index := int64(wal.lastIndex + 1)
 	temp := fmt.Sprintf(FORMAT_NAME, index)
@@ -306,15 +384,16 @@ func (wal *WAL) newSegment() (*Segment, error) {
 	temp = strings.Join([]string{temp, END_EXT}, "")
 	temp = strings.Join([]string{temp, WAL_EXT}, ".")
 
-	wal.tail, err = os.Create(temp)
+	wal.tail, err = open(temp)
 	if err != nil {
 		return nil, err
 	}
 
 	segment := &Segment{
-		index:  index,
-		path:   temp,
-		synced: false,
+		index:    index,
+		path:     temp,
+		synced:   false,
+		startCRC: wal.lastCRC,
 	}
 
 	wal.lastIndex = index
@@ -322,17 +401,19 @@ func (wal *WAL) newSegment() (*Segment, error) {
 	return segment, nil
 }
 
-func (wal *WAL) cleanLog() {
+// checkpointIfNeeded takes a checkpoint once more than lowMark segments
+// have piled up, superseding the old cleanLog's blind deletion with one
+// that preserves every live key.
+func (wal *WAL) checkpointIfNeeded(ctx context.Context) {
 	wal.mu.Lock()
-	defer wal.mu.Unlock()
+	due := len(wal.segments) > wal.lowMark
+	wal.mu.Unlock()
+	if !due {
+		return
+	}
 
-	for i := len(wal.segments) - 1; i >= wal.lowMark; i-- {
-		err := os.Remove(wal.segments[i].Path())
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-		wal.removeIndex(i)
+	if _, err := wal.Checkpoint(ctx, func(Entry) bool { return true }); err != nil {
+		fmt.Println(err)
 	}
 }
 
@@ -341,7 +422,7 @@ func (wal *WAL) clean(ctx context.Context) {
 		for {
 			select {
 			case <-time.Tick(wal.d):
-				wal.cleanLog()
+				wal.checkpointIfNeeded(ctx)
 			case <-ctx.Done():
 				return
 			}
@@ -349,20 +430,13 @@ func (wal *WAL) clean(ctx context.Context) {
 	}()
 }
 
-func NewWAL(path string, maxSize int64, duration time.Duration, lowMark int) *WAL {
-	return &WAL{
-		path:      path,
-		segments:  []*Segment{},
-		maxSize:   maxSize,
-		d:         duration,
-		lowMark:   lowMark,
-		lastIndex: -1,
-	}
-}
-
 func main() {
-	wal := NewWAL("/Users/milossimic/Desktop/wal", 100, time.Second, 2) //20971520) //20MB segment size
-	err := wal.Open()
+	wal, err := NewWAL("/Users/milossimic/Desktop/wal", 100, time.Second, 2, 1024, WALOptions{SyncMode: SyncAlways}) //20971520) //20MB segment size
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	err = wal.Open()
 	if err != nil {
 		fmt.Println(err)
 		return
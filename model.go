@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"github.com/MilosSimic/fmmap"
 	"github.com/MilosSimic/lru"
 	"hash/crc32"
@@ -23,26 +24,54 @@ const (
 	WAL_EXT     = "wal"
 	END_EXT     = "_END"
 	FORMAT_NAME = "00000000000000000000%d"
+
+	CHECKPOINT_DIR    = "checkpoints"
+	CHECKPOINT_FORMAT = "checkpoint.%020d.wal"
 )
 
 type WAL struct {
-	mu        sync.Mutex
-	path      string
-	segments  []*Segment
-	tail      *fmmap.FMMAP
-	d         time.Duration
-	lowMark   int
-	lastIndex int64
-	cache     *lru.LRU
+	mu              sync.Mutex
+	path            string
+	segments        []*Segment
+	tail            *fmmap.FMMAP
+	maxSize         int64
+	d               time.Duration
+	lowMark         int
+	lastIndex       int64
+	cache           *lru.LRU
+	crcTable        *crc32.Table
+	lastCRC         uint32 // rolling CRC of the last record written/verified, chained across segments
+	checkpointIndex int64  // index of the last checkpoint covering segments [0, checkpointIndex], or -1 if none
+	checkpointPath  string // path of that checkpoint's survivor file, or "" if none
+	opts            WALOptions
+	commitQueue     chan *commitRequest // Batch.Commit requests waiting on the syncer goroutine
 }
 
 type Segment struct {
-	path  string
-	index int64
-	size  int64
-	data  []byte
+	path     string
+	index    int64
+	size     int64
+	data     []byte
+	synced   bool
+	startCRC uint32 // seed for this segment's first record: the previous segment's ending CRC
+}
+
+// ErrCRCMismatch is returned by a Decoder when a record's chained CRC
+// does not match the value stored on disk, meaning the chain was broken
+// by a torn write or bit rot somewhere at or before Offset.
+type ErrCRCMismatch struct {
+	Index  int64
+	Offset int64
 }
 
+func (e *ErrCRCMismatch) Error() string {
+	return fmt.Sprintf("wal: crc mismatch at record %d, offset %d", e.Index, e.Offset)
+}
+
+// ErrKeyNotFound is returned by Lookup when key isn't present in any
+// segment (or its latest write was a tombstone).
+var ErrKeyNotFound = errors.New("wal: key not found")
+
 type Entry struct {
 	Crc       uint32
 	Timestamp uint64
@@ -82,8 +111,16 @@ func (s *Segment) Index() int64 {
 	return s.index
 }
 
-func CRC32(str string) uint32 {
-	return crc32.ChecksumIEEE([]byte(str))
+func (s *Segment) StartCRC() uint32 {
+	return s.startCRC
+}
+
+func (s *Segment) IsSynced() bool {
+	return s.synced
+}
+
+func (s *Segment) SetSynced(synced bool) {
+	s.synced = synced
 }
 
 func (wal *WAL) Close() {
@@ -102,20 +139,27 @@ func (wal *WAL) removeIndex(index int) {
 	wal.segments = append(wal.segments[:index], wal.segments[index+1:]...)
 }
 
-func NewWAL(path string, duration time.Duration, lowMark int, cap int) (*WAL, error) {
+func NewWAL(path string, maxSize int64, duration time.Duration, lowMark int, cap int, opts WALOptions) (*WAL, error) {
 	cache, err := lru.NewLRU(cap, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	return &WAL{
-		path:      path,
-		segments:  []*Segment{},
-		d:         duration,
-		lowMark:   lowMark,
-		lastIndex: 0,
-		cache:     cache,
-	}, nil
+	wal := &WAL{
+		path:            path,
+		segments:        []*Segment{},
+		maxSize:         maxSize,
+		d:               duration,
+		lowMark:         lowMark,
+		lastIndex:       0,
+		cache:           cache,
+		crcTable:        crc32.IEEETable,
+		checkpointIndex: -1,
+		opts:            opts,
+		commitQueue:     make(chan *commitRequest, 64),
+	}
+	wal.runSyncer()
+	return wal, nil
 }
 
 func (wal *WAL) TailPath() (string, error) {
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// segmentsReader is a multiReadCloser-style io.ReadCloser: it walks a
+// fixed list of segment files in order, presenting them to the caller as
+// one continuous stream of encoded records so a Decoder can read across
+// segment boundaries without the caller ever touching a segment file
+// directly.
+type segmentsReader struct {
+	wal     *WAL
+	indexes []int64
+	pos     int
+	cur     io.ReadCloser
+}
+
+// segmentsFrom returns a segmentsReader over every segment at or after
+// fromIndex, in ascending order.
+func (wal *WAL) segmentsFrom(fromIndex int64) *segmentsReader {
+	indexes := []int64{}
+	for _, s := range wal.segments {
+		if s.Index() >= fromIndex {
+			indexes = append(indexes, s.Index())
+		}
+	}
+	return &segmentsReader{wal: wal, indexes: indexes}
+}
+
+func (r *segmentsReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if r.pos >= len(r.indexes) {
+				return 0, io.EOF
+			}
+
+			segment, err := r.wal.findSegment(r.indexes[r.pos])
+			if err != nil {
+				return 0, err
+			}
+			if segment == nil {
+				return 0, os.ErrNotExist
+			}
+
+			r.cur, err = r.wal.segmentReader(segment)
+			if err != nil {
+				return 0, err
+			}
+			r.pos++
+		}
+
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *segmentsReader) Close() error {
+	if r.cur != nil {
+		return r.cur.Close()
+	}
+	return nil
+}
+
+// StreamFrom returns a Decoder that reads every record starting at
+// fromIndex's segment through to the end of the log, transparently
+// crossing segment boundaries.
+func (wal *WAL) StreamFrom(fromIndex int64) (*Decoder, io.Closer, error) {
+	segment, err := wal.findSegment(fromIndex)
+	if err != nil {
+		return nil, nil, err
+	}
+	seed := uint32(0)
+	if segment != nil {
+		seed = segment.startCRC
+	}
+
+	r := wal.segmentsFrom(fromIndex)
+	return NewDecoder(r, seed, wal.crcTable), r, nil
+}
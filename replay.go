@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"golang.org/x/sync/errgroup"
+	"io"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// ReplayStats summarizes a completed Replay.
+type ReplayStats struct {
+	Entries  int64
+	Bytes    int64
+	Duration time.Duration
+}
+
+// segmentBatch is what a decode worker hands off: one segment's entries,
+// tagged with that segment's index so the merge step can keep things in
+// WAL order.
+type segmentBatch struct {
+	index   int64
+	entries []Entry
+}
+
+// Replay first applies the latest checkpoint's survivors, if any - the
+// keys Checkpoint already compacted out of the segments below - then
+// decodes every remaining segment and feeds the resulting records to
+// apply, in WAL order. Decoding - the CPU-bound CRC verification and
+// field parsing - is spread across runtime.GOMAXPROCS(0) workers, each
+// given a contiguous range of segments so within a worker segments still
+// decode in order. A single serial applier goroutine then merges the
+// workers' output back into segment-index order and calls apply, so
+// apply is never called concurrently and always sees records in true WAL
+// order rather than just per-key order.
+//
+// This is a deliberate departure from an earlier design that partitioned
+// segments by CRC32(key)%N and applied each partition independently:
+// that scheme could only guarantee per-key ordering, not true WAL order,
+// and needed an UnknownRefs count on ReplayStats to track records it
+// couldn't attribute to a partition. Applying serially in segment-index
+// order makes both unnecessary - ReplayStats has no UnknownRefs field
+// because there's nothing it would ever report. The tradeoff: each
+// worker's output channel is sized to its whole range
+// (make(chan segmentBatch, len(r))), so a worker's decoded entries sit
+// fully in memory until the applier drains them rather than streaming
+// through a bounded channel - acceptable since decoding, not buffering,
+// is what Replay was slow at.
+func (wal *WAL) Replay(ctx context.Context, apply func([]Entry) error) (ReplayStats, error) {
+	start := time.Now()
+	var stats ReplayStats
+
+	if wal.checkpointPath != "" {
+		survivors, err := wal.decodeCheckpoint(wal.checkpointPath)
+		if err != nil {
+			return stats, err
+		}
+		if len(survivors) > 0 {
+			if err := apply(survivors); err != nil {
+				return stats, err
+			}
+			stats.Entries += int64(len(survivors))
+			for _, e := range survivors {
+				stats.Bytes += int64(VALUE_SIZE) + int64(len(e.Key)) + int64(len(e.Value))
+			}
+		}
+	}
+
+	segments := make([]*Segment, 0, len(wal.segments))
+	for _, s := range wal.segments {
+		if s.Index() <= wal.checkpointIndex {
+			// Already folded into the last checkpoint - nothing left to replay.
+			continue
+		}
+		segments = append(segments, s)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].Index() < segments[j].Index() })
+	if len(segments) == 0 {
+		stats.Duration = time.Since(start)
+		return stats, nil
+	}
+
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(segments) {
+		workers = len(segments)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	ranges := partitionSegments(segments, workers)
+
+	outputs := make([]chan segmentBatch, len(ranges))
+	for i, r := range ranges {
+		outputs[i] = make(chan segmentBatch, len(r))
+	}
+
+	decodeGroup, decodeCtx := errgroup.WithContext(ctx)
+	for i, r := range ranges {
+		i, r := i, r
+		decodeGroup.Go(func() error {
+			defer close(outputs[i])
+			for _, segment := range r {
+				select {
+				case <-decodeCtx.Done():
+					return decodeCtx.Err()
+				default:
+				}
+
+				entries, err := wal.decodeSegment(segment)
+				if err != nil {
+					return err
+				}
+				outputs[i] <- segmentBatch{index: segment.Index(), entries: entries}
+			}
+			return nil
+		})
+	}
+
+	// Single serial applier: each output channel already yields its range
+	// in segment order, and the ranges themselves were built in ascending
+	// index order, so draining outputs front to back and calling apply
+	// inline preserves true WAL order with no concurrent apply calls.
+	for _, out := range outputs {
+		for batch := range out {
+			if err := apply(batch.entries); err != nil {
+				decodeGroup.Wait()
+				return stats, err
+			}
+			stats.Entries += int64(len(batch.entries))
+			for _, e := range batch.entries {
+				stats.Bytes += int64(VALUE_SIZE) + int64(len(e.Key)) + int64(len(e.Value))
+			}
+		}
+	}
+
+	if err := decodeGroup.Wait(); err != nil {
+		return stats, err
+	}
+
+	stats.Duration = time.Since(start)
+	return stats, nil
+}
+
+// decodeSegment reads and verifies every record in segment.
+func (wal *WAL) decodeSegment(segment *Segment) ([]Entry, error) {
+	r, err := wal.segmentReader(segment)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	dec := NewDecoder(r, segment.startCRC, wal.crcTable)
+	entries := []Entry{}
+	for {
+		e, err := dec.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, *e)
+	}
+	return entries, nil
+}
+
+// partitionSegments splits segments (already sorted by index) into n
+// contiguous, roughly equal ranges.
+func partitionSegments(segments []*Segment, n int) [][]*Segment {
+	ranges := make([][]*Segment, 0, n)
+	size := len(segments) / n
+	rem := len(segments) % n
+
+	start := 0
+	for i := 0; i < n; i++ {
+		chunk := size
+		if i < rem {
+			chunk++
+		}
+		if chunk == 0 {
+			continue
+		}
+		ranges = append(ranges, segments[start:start+chunk])
+		start += chunk
+	}
+	return ranges
+}